@@ -0,0 +1,174 @@
+/*
+   Copyright 2014 Krishna Raman <kraman@gmail.com>
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package netfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+)
+
+// NFConntrackTuple is one direction (original or reply) of a conntrack
+// entry's flow key.
+type NFConntrackTuple struct {
+	SrcIP   net.IP
+	DstIP   net.IP
+	Proto   uint8
+	SrcPort uint16
+	DstPort uint16
+}
+
+// NFConntrack holds the conntrack entry the kernel attaches to a packet as
+// an NFQA_CT attribute when the owning queue was created with
+// NFQueueFlagConntrack. It is nil when the flag wasn't set or the packet
+// has no associated connection.
+type NFConntrack struct {
+	ID     uint32
+	Mark   uint32
+	Zone   uint16
+	Status uint32
+	Helper string
+	Orig   NFConntrackTuple
+	Reply  NFConntrackTuple
+}
+
+// CTA_* attribute types (linux/netfilter/nfnetlink_conntrack.h) nested
+// inside NFQA_CT, and the CTA_TUPLE_*/CTA_IP_*/CTA_PROTO_* types nested
+// inside a CTA_TUPLE_ORIG/CTA_TUPLE_REPLY in turn.
+const (
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+	ctaStatus     = 3
+	ctaHelp       = 5
+	ctaMark       = 8
+	ctaID         = 12
+	ctaZone       = 18
+	// CTA_MARK_MASK isn't in every kernel's nfnetlink_conntrack.h; this
+	// is its value on the kernels that do define it.
+	ctaMarkMask = 21
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	ctaHelpName = 1
+
+	// nlaFNested marks a netlink attribute's value as itself a run of
+	// nested attributes (NLA_F_NESTED).
+	nlaFNested = 0x8000
+)
+
+// parseNestedAttrs walks a run of netlink TLV attributes (a 4-byte header
+// of length and type, data padded to a 4-byte boundary) and returns the
+// last value seen for each attribute type, with NLA_F_NESTED stripped from
+// the type. It is used both for a packet's top-level NFQA_* attributes and
+// the CTA_* attributes nested inside NFQA_CT.
+func parseNestedAttrs(buf []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(buf) >= 4 {
+		attrLen := binary.LittleEndian.Uint16(buf[0:2])
+		attrType := binary.LittleEndian.Uint16(buf[2:4]) &^ nlaFNested
+		if attrLen < 4 || int(attrLen) > len(buf) {
+			return attrs
+		}
+		attrs[attrType] = buf[4:attrLen]
+
+		aligned := (int(attrLen) + 3) &^ 3
+		if aligned >= len(buf) {
+			return attrs
+		}
+		buf = buf[aligned:]
+	}
+	return attrs
+}
+
+func decodeConntrackTuple(buf []byte) NFConntrackTuple {
+	var t NFConntrackTuple
+
+	attrs := parseNestedAttrs(buf)
+
+	if v, ok := attrs[ctaTupleIP]; ok {
+		ip := parseNestedAttrs(v)
+		switch {
+		case len(ip[ctaIPv4Src]) == 4:
+			t.SrcIP = net.IP(append([]byte(nil), ip[ctaIPv4Src]...))
+		case len(ip[ctaIPv6Src]) == 16:
+			t.SrcIP = net.IP(append([]byte(nil), ip[ctaIPv6Src]...))
+		}
+		switch {
+		case len(ip[ctaIPv4Dst]) == 4:
+			t.DstIP = net.IP(append([]byte(nil), ip[ctaIPv4Dst]...))
+		case len(ip[ctaIPv6Dst]) == 16:
+			t.DstIP = net.IP(append([]byte(nil), ip[ctaIPv6Dst]...))
+		}
+	}
+
+	if v, ok := attrs[ctaTupleProto]; ok {
+		proto := parseNestedAttrs(v)
+		if p := proto[ctaProtoNum]; len(p) >= 1 {
+			t.Proto = p[0]
+		}
+		if p := proto[ctaProtoSrcPort]; len(p) >= 2 {
+			t.SrcPort = binary.BigEndian.Uint16(p)
+		}
+		if p := proto[ctaProtoDstPort]; len(p) >= 2 {
+			t.DstPort = binary.BigEndian.Uint16(p)
+		}
+	}
+
+	return t
+}
+
+// decodeConntrack parses the raw payload of an NFQA_CT attribute.
+func decodeConntrack(raw []byte) *NFConntrack {
+	attrs := parseNestedAttrs(raw)
+	ct := &NFConntrack{}
+
+	if v := attrs[ctaID]; len(v) >= 4 {
+		ct.ID = binary.BigEndian.Uint32(v)
+	}
+	if v := attrs[ctaMark]; len(v) >= 4 {
+		ct.Mark = binary.BigEndian.Uint32(v)
+	}
+	if v := attrs[ctaStatus]; len(v) >= 4 {
+		ct.Status = binary.BigEndian.Uint32(v)
+	}
+	if v := attrs[ctaZone]; len(v) >= 2 {
+		ct.Zone = binary.BigEndian.Uint16(v)
+	}
+	if v, ok := attrs[ctaHelp]; ok {
+		if name := parseNestedAttrs(v)[ctaHelpName]; name != nil {
+			ct.Helper = string(bytes.TrimRight(name, "\x00"))
+		}
+	}
+	if v, ok := attrs[ctaTupleOrig]; ok {
+		ct.Orig = decodeConntrackTuple(v)
+	}
+	if v, ok := attrs[ctaTupleReply]; ok {
+		ct.Reply = decodeConntrackTuple(v)
+	}
+
+	return ct
+}
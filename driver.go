@@ -0,0 +1,93 @@
+/*
+   Copyright 2014 Krishna Raman <kraman@gmail.com>
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package netfilter
+
+import "time"
+
+// driver abstracts the transport NFQueue uses to talk to the kernel's
+// NFQUEUE subsystem. The default build uses the libnetfilter_queue cgo
+// bindings (driver_cgo.go); building with the "netlink" tag switches to a
+// pure-Go implementation that speaks NFNETLINK_SUBSYS_QUEUE directly over
+// an AF_NETLINK socket (driver_netlink.go), removing the cgo/pkg-config
+// dependency at the cost of reimplementing message encoding by hand.
+//
+// NFQueue and NFPacket only ever see this interface, so their public API
+// is identical regardless of which driver was compiled in.
+type driver interface {
+	// Open acquires the underlying handle (an nfnetlink socket).
+	Open() error
+
+	// Bind and Unbind (de)register the driver as the packet handler for a
+	// protocol family (AF_INET, AF_INET6).
+	Bind(af int) error
+	Unbind(af int) error
+
+	// CreateQueue binds to queueId and arranges for every packet the
+	// kernel subsequently delivers to be passed to deliver. deliver may
+	// block; drivers must not call it while holding a lock that Verdict
+	// or Close also need.
+	CreateQueue(queueId uint16, deliver func(NFPacket)) error
+
+	// SetMode selects the copy mode (e.g. NFQNL_COPY_PACKET) and how many
+	// bytes of each packet the kernel should copy.
+	SetMode(mode uint8, rangeLen uint32) error
+
+	// SetMaxLen sets the kernel-side queue length.
+	SetMaxLen(maxLen uint32) error
+
+	// SetFlags sets the given NFQA_CFG_F_* flags (see NFQueueFlag) on the
+	// queue, e.g. NFQueueFlagFailOpen, NFQueueFlagConntrack.
+	SetFlags(flags NFQueueFlag) error
+
+	// Recv blocks reading and dispatching packets to the CreateQueue
+	// callback until the driver is closed or an unrecoverable error
+	// occurs, at which point it returns.
+	Recv() error
+
+	// Verdict sets the verdict for a single packet. mark and payload are
+	// nil unless the caller wants to set a mark (SetVerdictMark) or
+	// inject replacement packet content (SetVerdictWithPacket).
+	Verdict(id uint32, v Verdict, mark *uint32, payload []byte) error
+
+	// VerdictBatch sets a single verdict for every not-yet-verdicted
+	// packet up to and including maxID (nfq_set_verdict_batch semantics).
+	VerdictBatch(maxID uint32, v Verdict) error
+
+	// VerdictWithCtMark sets a packet's verdict and additionally sets the
+	// connection's ctmark (masked by ctmask) via the NFQA_CT verdict
+	// extension. Requires the owning queue to have been created with
+	// NFQueueFlagConntrack.
+	VerdictWithCtMark(id uint32, v Verdict, ctmark, ctmask uint32) error
+
+	// SetErrorHandler registers the func the driver reports asynchronous,
+	// unattributable-to-a-single-call errors through (e.g. a callback
+	// invoked for an already-torn-down queue, or a forced close on
+	// timeout), backing NFQueue.Errors(). f may be called concurrently
+	// with any other driver method and must not block.
+	SetErrorHandler(f func(error))
+
+	// SetPooledBuffers opts a queue into delivering NFPacket.Packet as a
+	// buffer borrowed from packetBufferPool instead of a fresh per-packet
+	// allocation (see NFQueueConfig.PooledBuffers). Must be called before
+	// CreateQueue.
+	SetPooledBuffers(enabled bool)
+
+	// Close releases the handle, unblocking any in-flight Recv. timeout
+	// bounds how long Close waits for the kernel/driver to acknowledge
+	// teardown before forcing the underlying file descriptor closed.
+	Close(timeout time.Duration) error
+}
@@ -0,0 +1,334 @@
+/*
+   Copyright 2014 Krishna Raman <kraman@gmail.com>
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//go:build !netlink
+
+package netfilter
+
+/*
+#cgo pkg-config: libnetfilter_queue
+#cgo CFLAGS: -Wall -Wno-unused-variable -I/usr/include -O2
+#cgo LDFLAGS: -L/usr/lib64/
+
+#include "netfilter.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// cgoEntry is what go_callback looks up by idx: the deliver func to hand
+// packets to, and the driver instance (needed to build a NFPacket that can
+// set its own verdict).
+type cgoEntry struct {
+	deliver func(NFPacket)
+	drv     *cgoDriver
+}
+
+var theTable = make(map[uint32]*cgoEntry, 0)
+var theTabeLock sync.RWMutex
+
+// qhTable maps a queue handle to the driver that created it, so go_callback
+// can still report an idx-miss (a packet delivered for a queue no longer in
+// theTable) to the right driver's error handler even though the normal
+// idx-based lookup failed.
+var qhTable = make(map[uintptr]*cgoDriver)
+var qhTableLock sync.RWMutex
+
+// cgoDriver is the default driver, backed by libnetfilter_queue via cgo.
+type cgoDriver struct {
+	h           *C.struct_nfq_handle
+	qh          *C.struct_nfq_q_handle
+	fd          C.int
+	idx         uint32
+	queueNum    uint16
+	reportError func(error)
+	pooled      bool
+}
+
+func newDriver() driver {
+	return &cgoDriver{}
+}
+
+func (d *cgoDriver) Open() error {
+	h, err := C.nfq_open()
+	if err != nil {
+		return fmt.Errorf("nfq_open: %v", err)
+	}
+	d.h = h
+	return nil
+}
+
+func (d *cgoDriver) Bind(af int) error {
+	if ret, err := C.nfq_bind_pf(d.h, C.int(af)); err != nil || ret < 0 {
+		return fmt.Errorf("nfq_bind_pf(%d): %v", af, err)
+	}
+	return nil
+}
+
+func (d *cgoDriver) Unbind(af int) error {
+	if ret, err := C.nfq_unbind_pf(d.h, C.int(af)); err != nil || ret < 0 {
+		return fmt.Errorf("nfq_unbind_pf(%d): %v", af, err)
+	}
+	return nil
+}
+
+func (d *cgoDriver) CreateQueue(queueId uint16, deliver func(NFPacket)) error {
+	d.queueNum = queueId
+	d.idx = uint32(time.Now().UnixNano())
+
+	theTabeLock.Lock()
+	theTable[d.idx] = &cgoEntry{deliver: deliver, drv: d}
+	theTabeLock.Unlock()
+
+	qh, err := C.CreateQueue(d.h, C.u_int16_t(queueId), C.u_int32_t(d.idx))
+	if err != nil || qh == nil {
+		theTabeLock.Lock()
+		delete(theTable, d.idx)
+		theTabeLock.Unlock()
+		return fmt.Errorf("nfq_create_queue: %v", err)
+	}
+	d.qh = qh
+
+	qhTableLock.Lock()
+	qhTable[uintptr(unsafe.Pointer(qh))] = d
+	qhTableLock.Unlock()
+
+	return nil
+}
+
+func (d *cgoDriver) SetErrorHandler(f func(error)) {
+	d.reportError = f
+}
+
+func (d *cgoDriver) SetPooledBuffers(enabled bool) {
+	d.pooled = enabled
+}
+
+func (d *cgoDriver) SetMode(mode uint8, rangeLen uint32) error {
+	if C.nfq_set_mode(d.qh, C.u_int8_t(mode), C.uint(rangeLen)) < 0 {
+		return fmt.Errorf("nfq_set_mode failed")
+	}
+	return nil
+}
+
+func (d *cgoDriver) SetMaxLen(maxLen uint32) error {
+	if ret, err := C.nfq_set_queue_maxlen(d.qh, C.u_int32_t(maxLen)); err != nil || ret < 0 {
+		return fmt.Errorf("nfq_set_queue_maxlen: %v", err)
+	}
+	return nil
+}
+
+func (d *cgoDriver) SetFlags(flags NFQueueFlag) error {
+	if ret, err := C.SetQueueFlags(d.qh, C.u_int32_t(flags), C.u_int32_t(flags)); err != nil || ret < 0 {
+		return fmt.Errorf("nfq_set_queue_flags(0x%x): %v", uint32(flags), err)
+	}
+	return nil
+}
+
+func (d *cgoDriver) Recv() error {
+	fd, err := C.nfq_fd(d.h)
+	if err != nil {
+		return fmt.Errorf("nfq_fd: %v", err)
+	}
+	d.fd = fd
+	if errno := C.Run(d.h, fd); errno != 0 {
+		err := fmt.Errorf("errno=%d", errno)
+		if d.reportError != nil {
+			d.reportError(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *cgoDriver) Verdict(id uint32, v Verdict, mark *uint32, payload []byte) error {
+	switch {
+	case payload != nil:
+		C.nfq_set_verdict(d.qh, C.uint32_t(id), C.uint(v), C.uint(len(payload)), (*C.uchar)(unsafe.Pointer(&payload[0])))
+	case mark != nil:
+		C.nfq_set_verdict2(d.qh, C.uint32_t(id), C.uint(v), C.uint(*mark), 0, nil)
+	default:
+		C.nfq_set_verdict(d.qh, C.uint32_t(id), C.uint(v), 0, nil)
+	}
+	return nil
+}
+
+func (d *cgoDriver) VerdictBatch(maxID uint32, v Verdict) error {
+	C.nfq_set_verdict_batch(d.qh, C.uint32_t(maxID), C.uint(v))
+	return nil
+}
+
+func (d *cgoDriver) VerdictWithCtMark(id uint32, v Verdict, ctmark, ctmask uint32) error {
+	if ret, err := C.SetVerdictWithCtMark(d.h, C.u_int16_t(d.queueNum), C.uint32_t(id), C.uint32_t(v), C.uint32_t(ctmark), C.uint32_t(ctmask)); err != nil || ret < 0 {
+		return fmt.Errorf("SetVerdictWithCtMark: %v", err)
+	}
+	return nil
+}
+
+func (d *cgoDriver) Close(timeout time.Duration) error {
+	C.stop_reading_packets()
+
+	timer := time.AfterFunc(timeout, func() {
+		err := fmt.Errorf("queue stuck, forcing close after %v", timeout)
+		if d.reportError != nil {
+			d.reportError(err)
+		}
+		C.close(d.fd)
+		d.closeNfq()
+	})
+
+	C.nfq_unbind_pf(d.h, AF_INET)
+	C.nfq_unbind_pf(d.h, AF_INET6)
+	if d.qh != nil {
+		if ret := C.nfq_destroy_queue(d.qh); ret != 0 {
+			err := fmt.Errorf("nfq_destroy_queue: %d", ret)
+			if d.reportError != nil {
+				d.reportError(err)
+			}
+		}
+		qhTableLock.Lock()
+		delete(qhTable, uintptr(unsafe.Pointer(d.qh)))
+		qhTableLock.Unlock()
+	}
+	timer.Stop()
+	d.closeNfq()
+
+	theTabeLock.Lock()
+	delete(theTable, d.idx)
+	theTabeLock.Unlock()
+
+	return nil
+}
+
+func (d *cgoDriver) closeNfq() {
+	if d.h != nil {
+		if ret := C.nfq_close(d.h); ret != 0 {
+			err := fmt.Errorf("nfq_close: %d", ret)
+			if d.reportError != nil {
+				d.reportError(err)
+			}
+		}
+	}
+}
+
+//export go_callback
+func go_callback(packetId C.uint32_t, idx uint32, qh *C.struct_nfq_q_handle, nfad *C.struct_nfq_data) {
+	var data *C.uchar
+	length := C.nfq_get_payload(nfad, &data)
+
+	theTabeLock.RLock()
+	entry, ok := theTable[idx]
+	theTabeLock.RUnlock()
+	if !ok {
+		disposition := "Dropping"
+		if FailureVerdict == NF_ACCEPT {
+			disposition = "[Fail-Open] Accepting"
+		}
+		fmt.Fprintf(os.Stderr, "%s packet, unexpectedly due to bad idx=%d\n", disposition, idx)
+
+		qhTableLock.RLock()
+		drv, drvOK := qhTable[uintptr(unsafe.Pointer(qh))]
+		qhTableLock.RUnlock()
+		if drvOK && drv.reportError != nil {
+			drv.reportError(fmt.Errorf("callback fired for unregistered idx=%d on queue %d", idx, drv.queueNum))
+		}
+
+		C.nfq_set_verdict(qh, packetId, C.uint(FailureVerdict), 0, nil)
+		return
+	}
+
+	payload, poolBuf := copyPayload(data, length, entry.drv.pooled)
+
+	p := NFPacket{
+		Packet:    payload,
+		Metadata:  extractMetadata(nfad),
+		Conntrack: extractConntrack(nfad),
+		drv:       entry.drv,
+		id:        uint32(packetId),
+		poolBuf:   poolBuf,
+	}
+
+	entry.deliver(p)
+}
+
+// copyPayload copies length bytes of C-owned payload data into Go memory,
+// borrowing from packetBufferPool when pooled is set (NFQueueConfig.PooledBuffers)
+// instead of allocating fresh, returning the buffer alongside the slice so
+// the caller can stash it on NFPacket for Release to hand back later.
+// length < 0 (nfq_get_payload found no payload attribute) yields a nil slice.
+func copyPayload(data *C.uchar, length C.int, pooled bool) (payload []byte, poolBuf *[]byte) {
+	if length < 0 {
+		return nil, nil
+	}
+	if !pooled {
+		return C.GoBytes(unsafe.Pointer(data), length), nil
+	}
+	poolBuf = packetBufferPool.Get().(*[]byte)
+	n := copy(*poolBuf, unsafe.Slice((*byte)(unsafe.Pointer(data)), int(length)))
+	return (*poolBuf)[:n], poolBuf
+}
+
+// extractConntrack pulls and decodes the NFQA_CT attribute, present when
+// the owning queue was created with NFQueueFlagConntrack, returning nil if
+// it's absent.
+func extractConntrack(nfad *C.struct_nfq_data) *NFConntrack {
+	attr := C.GetRawAttr(nfad, C.NFQA_CT)
+	if attr == nil {
+		return nil
+	}
+	raw := C.GoBytes(unsafe.Pointer(C.AttrData(attr)), C.AttrPayloadLen(attr))
+	return decodeConntrack(raw)
+}
+
+// extractMetadata pulls the per-packet attributes libnetfilter_queue makes
+// available alongside the payload out of nfad. Getters that have nothing to
+// report (e.g. no bridging, no hardware address) leave the corresponding
+// field at its zero value.
+func extractMetadata(nfad *C.struct_nfq_data) NFMetadata {
+	md := NFMetadata{
+		Mark: uint32(C.nfq_get_nfmark(nfad)),
+	}
+
+	if ph := C.nfq_get_msg_packet_hdr(nfad); ph != nil {
+		md.HookNumber = uint8(ph.hook)
+		md.ProtocolFamily = uint16(C.ntohs(ph.hw_protocol))
+	}
+
+	md.InIfIndex = uint32(C.nfq_get_indev(nfad))
+	md.OutIfIndex = uint32(C.nfq_get_outdev(nfad))
+	md.PhysInIfIndex = uint32(C.nfq_get_physindev(nfad))
+	md.PhysOutIfIndex = uint32(C.nfq_get_physoutdev(nfad))
+
+	if hw := C.nfq_get_packet_hw(nfad); hw != nil {
+		hwAddrLen := C.ntohs(hw.hw_addrlen)
+		if hwAddrLen > 0 && int(hwAddrLen) <= len(hw.hw_addr) {
+			md.HwAddr = C.GoBytes(unsafe.Pointer(&hw.hw_addr[0]), C.int(hwAddrLen))
+		}
+	}
+
+	var tv C.struct_timeval
+	if C.nfq_get_timestamp(nfad, &tv) == 0 && tv.tv_sec != 0 {
+		md.Timestamp = time.Unix(int64(tv.tv_sec), int64(tv.tv_usec)*1000)
+	}
+
+	return md
+}
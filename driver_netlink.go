@@ -0,0 +1,394 @@
+/*
+   Copyright 2014 Krishna Raman <kraman@gmail.com>
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+//go:build netlink
+
+package netfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// This file implements the driver interface directly on top of an
+// AF_NETLINK/NETLINK_NETFILTER socket, talking to NFNL_SUBSYS_QUEUE the
+// same way libnetfilter_queue does internally. It exists so consumers who
+// can't or don't want a libnetfilter_queue build dependency can still use
+// the package; build with `-tags netlink` to select it over driver_cgo.go.
+//
+// Netlink message and attribute headers are read/written in host byte
+// order, matching struct nlmsghdr/nlattr on Linux; nfgenmsg's res_id and
+// attribute payloads follow netfilter's own convention of network
+// (big-endian) byte order.
+// This implementation assumes a little-endian host, true of every
+// mainstream Linux target for this package (amd64, arm64, 386, arm).
+
+const (
+	netlinkNetfilter = 12 // NETLINK_NETFILTER
+
+	// solNetlink/netlinkNoEnobufs configure NETLINK_NO_ENOBUFS (see
+	// Open): package syscall doesn't export SOL_NETLINK on every arch
+	// this package targets, so these are hardcoded the same way
+	// netlinkNetfilter above is.
+	solNetlink       = 270 // SOL_NETLINK
+	netlinkNoEnobufs = 5   // NETLINK_NO_ENOBUFS
+
+	nfnlSubsysQueue = 3 // NFNL_SUBSYS_QUEUE
+
+	nfqnlMsgPacket       = 0
+	nfqnlMsgVerdict      = 1
+	nfqnlMsgConfig       = 2
+	nfqnlMsgVerdictBatch = 3
+
+	nfqaPacketHdr         = 1
+	nfqaVerdictHdr        = 2
+	nfqaMark              = 3
+	nfqaTimestamp         = 4
+	nfqaIfindexIndev      = 5
+	nfqaIfindexOutdev     = 6
+	nfqaIfindexPhysindev  = 7
+	nfqaIfindexPhysoutdev = 8
+	nfqaHwaddr            = 9
+	nfqaPayload           = 10
+	nfqaCT                = 11
+
+	nfqaCfgCmd         = 1
+	nfqaCfgParams      = 2
+	nfqaCfgQueueMaxlen = 3
+	nfqaCfgMask        = 4
+	nfqaCfgFlags       = 5
+
+	nfqnlCfgCmdBind     = 1
+	nfqnlCfgCmdUnbind   = 2
+	nfqnlCfgCmdPfBind   = 3
+	nfqnlCfgCmdPfUnbind = 4
+
+	nfqnlCopyPacket = 2
+
+	nlmFRequest = 0x1
+	nlmFAck     = 0x4
+)
+
+func nfnlMsgType(subsys, msgType uint8) uint16 {
+	return uint16(subsys)<<8 | uint16(msgType)
+}
+
+// nlDriver is the pure-Go netlink driver.
+type nlDriver struct {
+	fd          int
+	seq         uint32
+	queueNum    uint16
+	deliver     func(NFPacket)
+	closed      chan struct{}
+	reportError func(error)
+	pooled      bool
+}
+
+func newDriver() driver {
+	return &nlDriver{closed: make(chan struct{})}
+}
+
+func (d *nlDriver) Open() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, netlinkNetfilter)
+	if err != nil {
+		return fmt.Errorf("socket(AF_NETLINK, NETLINK_NETFILTER): %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("bind netlink socket: %v", err)
+	}
+	// NETLINK_NO_ENOBUFS asks the kernel to drop packets instead of
+	// returning ENOBUFS once our receive buffer can't keep up; without
+	// it, the first ENOBUFS under high PPS would end Recv for good, the
+	// same failure mode as the cgo backend this driver exists to avoid.
+	if err := syscall.SetsockoptInt(fd, solNetlink, netlinkNoEnobufs, 1); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("setsockopt(NETLINK_NO_ENOBUFS): %v", err)
+	}
+	d.fd = fd
+	return nil
+}
+
+func (d *nlDriver) Bind(af int) error {
+	return d.sendConfigCmd(nfqnlCfgCmdPfBind, 0, uint16(af))
+}
+
+func (d *nlDriver) Unbind(af int) error {
+	return d.sendConfigCmd(nfqnlCfgCmdPfUnbind, 0, uint16(af))
+}
+
+func (d *nlDriver) CreateQueue(queueId uint16, deliver func(NFPacket)) error {
+	d.queueNum = queueId
+	d.deliver = deliver
+	return d.sendConfigCmd(nfqnlCfgCmdBind, queueId, 0)
+}
+
+func (d *nlDriver) SetMode(mode uint8, rangeLen uint32) error {
+	params := make([]byte, 5)
+	binary.BigEndian.PutUint32(params[0:4], rangeLen)
+	params[4] = mode
+	return d.sendConfig(d.queueNum, nfqaCfgParams, params)
+}
+
+func (d *nlDriver) SetMaxLen(maxLen uint32) error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, maxLen)
+	return d.sendConfig(d.queueNum, nfqaCfgQueueMaxlen, buf)
+}
+
+func (d *nlDriver) SetFlags(flags NFQueueFlag) error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(flags))
+
+	// The kernel only applies NFQA_CFG_FLAGS when NFQA_CFG_MASK is in the
+	// same message, so both go out together.
+	var attrs bytes.Buffer
+	writeNlAttr(&attrs, nfqaCfgFlags, buf)
+	writeNlAttr(&attrs, nfqaCfgMask, buf)
+	return d.send(nfqnlMsgConfig, d.queueNum, attrs.Bytes())
+}
+
+func (d *nlDriver) SetErrorHandler(f func(error)) {
+	d.reportError = f
+}
+
+func (d *nlDriver) SetPooledBuffers(enabled bool) {
+	d.pooled = enabled
+}
+
+func (d *nlDriver) Recv() error {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := syscall.Recvfrom(d.fd, buf, 0)
+		if err != nil {
+			select {
+			case <-d.closed:
+				return nil
+			default:
+			}
+			rerr := fmt.Errorf("recvfrom: %v", err)
+			if d.reportError != nil {
+				d.reportError(rerr)
+			}
+			return rerr
+		}
+		d.handleMessages(buf[:n])
+	}
+}
+
+func (d *nlDriver) handleMessages(buf []byte) {
+	for len(buf) >= 16 {
+		msgLen := binary.LittleEndian.Uint32(buf[0:4])
+		msgType := binary.LittleEndian.Uint16(buf[4:6])
+		if msgLen < 16 || int(msgLen) > len(buf) {
+			return
+		}
+
+		if msgType == nfnlMsgType(nfnlSubsysQueue, nfqnlMsgPacket) {
+			d.handlePacket(buf[16:msgLen])
+		}
+
+		// advance to the next message, aligned to 4 bytes (NLMSG_ALIGNTO)
+		aligned := (msgLen + 3) &^ 3
+		if int(aligned) >= len(buf) {
+			return
+		}
+		buf = buf[aligned:]
+	}
+}
+
+func (d *nlDriver) handlePacket(payload []byte) {
+	if len(payload) < 4 {
+		return
+	}
+	attrs := parseNestedAttrs(payload[4:]) // skip the nfgenmsg header
+
+	p := NFPacket{drv: d}
+
+	if hdr, ok := attrs[nfqaPacketHdr]; ok && len(hdr) >= 4 {
+		p.id = binary.BigEndian.Uint32(hdr[0:4])
+		if len(hdr) >= 7 {
+			p.Metadata.ProtocolFamily = binary.BigEndian.Uint16(hdr[4:6])
+			p.Metadata.HookNumber = hdr[6]
+		}
+	}
+	if v, ok := attrs[nfqaPayload]; ok {
+		if d.pooled {
+			poolBuf := packetBufferPool.Get().(*[]byte)
+			n := copy(*poolBuf, v)
+			p.Packet = (*poolBuf)[:n]
+			p.poolBuf = poolBuf
+		} else {
+			p.Packet = append([]byte(nil), v...)
+		}
+	}
+	if v, ok := attrs[nfqaMark]; ok && len(v) >= 4 {
+		p.Metadata.Mark = binary.BigEndian.Uint32(v)
+	}
+	if v, ok := attrs[nfqaIfindexIndev]; ok && len(v) >= 4 {
+		p.Metadata.InIfIndex = binary.BigEndian.Uint32(v)
+	}
+	if v, ok := attrs[nfqaIfindexOutdev]; ok && len(v) >= 4 {
+		p.Metadata.OutIfIndex = binary.BigEndian.Uint32(v)
+	}
+	if v, ok := attrs[nfqaIfindexPhysindev]; ok && len(v) >= 4 {
+		p.Metadata.PhysInIfIndex = binary.BigEndian.Uint32(v)
+	}
+	if v, ok := attrs[nfqaIfindexPhysoutdev]; ok && len(v) >= 4 {
+		p.Metadata.PhysOutIfIndex = binary.BigEndian.Uint32(v)
+	}
+	if v, ok := attrs[nfqaHwaddr]; ok && len(v) >= 4 {
+		hwAddrLen := binary.BigEndian.Uint16(v[0:2])
+		if int(hwAddrLen) <= len(v)-4 {
+			p.Metadata.HwAddr = append([]byte(nil), v[4:4+hwAddrLen]...)
+		}
+	}
+	if v, ok := attrs[nfqaTimestamp]; ok && len(v) >= 16 {
+		sec := int64(binary.BigEndian.Uint64(v[0:8]))
+		usec := int64(binary.BigEndian.Uint64(v[8:16]))
+		if sec != 0 {
+			p.Metadata.Timestamp = time.Unix(sec, usec*1000)
+		}
+	}
+	if v, ok := attrs[nfqaCT]; ok {
+		p.Conntrack = decodeConntrack(v)
+	}
+
+	d.deliver(p)
+}
+
+func (d *nlDriver) Verdict(id uint32, v Verdict, mark *uint32, payload []byte) error {
+	var attrs bytes.Buffer
+
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(v))
+	binary.BigEndian.PutUint32(hdr[4:8], id)
+	writeNlAttr(&attrs, nfqaVerdictHdr, hdr)
+
+	if mark != nil {
+		m := make([]byte, 4)
+		binary.BigEndian.PutUint32(m, *mark)
+		writeNlAttr(&attrs, nfqaMark, m)
+	}
+	if payload != nil {
+		writeNlAttr(&attrs, nfqaPayload, payload)
+	}
+
+	return d.send(nfqnlMsgVerdict, d.queueNum, attrs.Bytes())
+}
+
+func (d *nlDriver) VerdictBatch(maxID uint32, v Verdict) error {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(v))
+	binary.BigEndian.PutUint32(hdr[4:8], maxID)
+
+	var attrs bytes.Buffer
+	writeNlAttr(&attrs, nfqaVerdictHdr, hdr)
+
+	return d.send(nfqnlMsgVerdictBatch, d.queueNum, attrs.Bytes())
+}
+
+// VerdictWithCtMark sets a packet's verdict and attaches a nested NFQA_CT
+// attribute carrying CTA_MARK/CTA_MARK_MASK, which the kernel applies to
+// the packet's connection when the owning queue was created with
+// NFQueueFlagConntrack.
+func (d *nlDriver) VerdictWithCtMark(id uint32, v Verdict, ctmark, ctmask uint32) error {
+	var attrs bytes.Buffer
+
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(v))
+	binary.BigEndian.PutUint32(hdr[4:8], id)
+	writeNlAttr(&attrs, nfqaVerdictHdr, hdr)
+
+	var ct bytes.Buffer
+	mark := make([]byte, 4)
+	binary.BigEndian.PutUint32(mark, ctmark)
+	writeNlAttr(&ct, ctaMark, mark)
+	mask := make([]byte, 4)
+	binary.BigEndian.PutUint32(mask, ctmask)
+	writeNlAttr(&ct, ctaMarkMask, mask)
+	writeNlAttr(&attrs, nfqaCT|nlaFNested, ct.Bytes())
+
+	return d.send(nfqnlMsgVerdict, d.queueNum, attrs.Bytes())
+}
+
+// Close closes the closed channel so a concurrent Recv returns cleanly,
+// then closes the socket. Unlike the cgo driver, there's no blocking kernel
+// round-trip to wait out here, so timeout is unused; it's accepted only to
+// satisfy the driver interface.
+func (d *nlDriver) Close(timeout time.Duration) error {
+	close(d.closed)
+	return syscall.Close(d.fd)
+}
+
+// sendConfigCmd sends an NFQNL_MSG_CONFIG message carrying an
+// NFQA_CFG_CMD attribute (bind/unbind a queue or a protocol family).
+func (d *nlDriver) sendConfigCmd(cmd uint8, queueNum uint16, pf uint16) error {
+	body := make([]byte, 4)
+	body[0] = cmd
+	binary.BigEndian.PutUint16(body[2:4], pf)
+
+	var attrs bytes.Buffer
+	writeNlAttr(&attrs, nfqaCfgCmd, body)
+
+	return d.send(nfqnlMsgConfig, queueNum, attrs.Bytes())
+}
+
+// sendConfig sends an NFQNL_MSG_CONFIG message carrying a single attribute.
+func (d *nlDriver) sendConfig(queueNum uint16, attrType uint16, data []byte) error {
+	var attrs bytes.Buffer
+	writeNlAttr(&attrs, attrType, data)
+	return d.send(nfqnlMsgConfig, queueNum, attrs.Bytes())
+}
+
+// send wraps attrs in an nfgenmsg header (res_id = queueNum) and an
+// nlmsghdr, then writes the resulting message to the socket.
+func (d *nlDriver) send(msgType uint8, queueNum uint16, attrs []byte) error {
+	d.seq++
+
+	body := make([]byte, 4+len(attrs))
+	body[0] = 0 // nfgen_family: AF_UNSPEC, queues aren't family-specific
+	body[1] = 0 // nfgen_version
+	binary.BigEndian.PutUint16(body[2:4], queueNum)
+	copy(body[4:], attrs)
+
+	msg := make([]byte, 16+len(body))
+	binary.LittleEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.LittleEndian.PutUint16(msg[4:6], nfnlMsgType(nfnlSubsysQueue, msgType))
+	binary.LittleEndian.PutUint16(msg[6:8], nlmFRequest|nlmFAck)
+	binary.LittleEndian.PutUint32(msg[8:12], d.seq)
+	binary.LittleEndian.PutUint32(msg[12:16], 0)
+	copy(msg[16:], body)
+
+	_, err := syscall.Write(d.fd, msg)
+	return err
+}
+
+// writeNlAttr appends a length-prefixed, 4-byte-aligned netlink attribute
+// to buf.
+func writeNlAttr(buf *bytes.Buffer, attrType uint16, data []byte) {
+	hdr := make([]byte, 4)
+	binary.LittleEndian.PutUint16(hdr[0:2], uint16(4+len(data)))
+	binary.LittleEndian.PutUint16(hdr[2:4], attrType)
+	buf.Write(hdr)
+	buf.Write(data)
+	if pad := (4 - len(data)%4) % 4; pad > 0 {
+		buf.Write(make([]byte, pad))
+	}
+}
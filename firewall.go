@@ -0,0 +1,52 @@
+/*
+   Copyright 2014 Krishna Raman <kraman@gmail.com>
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package netfilter
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// InstallCtMarkBypassRule adds a rule to chain (in table) that matches
+// packets whose connection mark equals mark under mask and accepts them
+// before they reach the NFQUEUE target. Pair it with SetVerdictWithCtMark:
+// mark a flow's first packet or two, then let this rule keep the rest of
+// the connection out of userspace entirely, the same short-circuit
+// OpenGFW's nfqueueConnMarkAccept/Drop rely on.
+//
+// table and chain must already exist and already contain the NFQUEUE rule
+// this is meant to run ahead of; InstallCtMarkBypassRule only inserts the
+// bypass rule at the head of the chain, it does not create chains or wire
+// up NFQUEUE itself. nft is
+// used when available, falling back to iptables.
+func InstallCtMarkBypassRule(table, chain string, mark, mask uint32) error {
+	if _, err := exec.LookPath("nft"); err == nil {
+		expr := fmt.Sprintf("ct mark and 0x%x == 0x%x accept", mask, mark&mask)
+		cmd := exec.Command("nft", "insert", "rule", "inet", table, chain, expr)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("nft insert rule %s %s: %v: %s", table, chain, err, out)
+		}
+		return nil
+	}
+
+	cmd := exec.Command("iptables", "-t", table, "-I", chain,
+		"-m", "connmark", "--mark", fmt.Sprintf("0x%x/0x%x", mark, mask), "-j", "ACCEPT")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables -t %s -I %s: %v: %s", table, chain, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright 2014 Krishna Raman <kraman@gmail.com>
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package netfilter
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// MultiQueue binds a contiguous range of queue-nums, the same range
+// `iptables ... --queue-balance` load-balances across, so a single program
+// can scale packet processing beyond one CPU. Each bound queue keeps its
+// own driver and read goroutine, so a slow consumer on one queue-num
+// doesn't stall kernel-side delivery on the others.
+type MultiQueue struct {
+	queues  []*NFQueue
+	packets chan NFPacket
+	errors  chan error
+	closed  chan struct{}
+}
+
+// NewMultiQueue binds queues [startQueueId, startQueueId+count), applying
+// cfg to each, and fans every queue's packets into the single channel
+// returned by GetPackets.
+func NewMultiQueue(startQueueId uint16, count int, cfg NFQueueConfig) (*MultiQueue, error) {
+	packets := make(chan NFPacket)
+
+	mq, err := newMultiQueue(startQueueId, count, cfg, func(nfq *NFQueue) {
+		for p := range nfq.GetPackets() {
+			packets <- p
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mq.packets = packets
+	return mq, nil
+}
+
+// NewMultiQueueWorkerPool is like NewMultiQueue, but instead of fanning
+// every queue's packets into one shared channel, it runs handler directly
+// on a dedicated, OS-thread-pinned goroutine per queue. This mirrors
+// Suricata's runmode-nfq worker design and avoids a shared channel
+// becoming the bottleneck once queue count exceeds a handful of CPUs.
+func NewMultiQueueWorkerPool(startQueueId uint16, count int, cfg NFQueueConfig, handler func(NFPacket)) (*MultiQueue, error) {
+	return newMultiQueue(startQueueId, count, cfg, func(nfq *NFQueue) {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		for p := range nfq.GetPackets() {
+			handler(p)
+		}
+	})
+}
+
+func newMultiQueue(startQueueId uint16, count int, cfg NFQueueConfig, worker func(*NFQueue)) (*MultiQueue, error) {
+	mq := &MultiQueue{errors: make(chan error), closed: make(chan struct{})}
+
+	for i := 0; i < count; i++ {
+		queueId := startQueueId + uint16(i)
+
+		nfq, err := NewNFQueueWithConfig(queueId, cfg)
+		if err != nil {
+			mq.Close()
+			return nil, fmt.Errorf("binding queue %d: %v", queueId, err)
+		}
+		mq.queues = append(mq.queues, nfq)
+
+		go worker(nfq)
+		go mq.forwardErrors(nfq)
+	}
+
+	return mq, nil
+}
+
+// forwardErrors copies nfq's errors into mq.errors until either nfq or mq
+// is closed. It's a method (rather than inlined into newMultiQueue) so it
+// can be driven directly in tests without standing up a real queue.
+func (mq *MultiQueue) forwardErrors(nfq *NFQueue) {
+	for {
+		select {
+		case err := <-nfq.Errors():
+			select {
+			case mq.errors <- err:
+			case <-mq.closed:
+				return
+			}
+		case <-nfq.Closed():
+			return
+		}
+	}
+}
+
+// GetPackets returns the channel packets from every bound queue are
+// delivered on. It is nil for a MultiQueue built with
+// NewMultiQueueWorkerPool, which delivers packets to its handler directly.
+func (mq *MultiQueue) GetPackets() <-chan NFPacket {
+	return mq.packets
+}
+
+// Errors returns the channel every bound queue's asynchronous errors (see
+// NFQueue.Errors) are fanned into. Like NFQueue.Errors, it is never closed,
+// so a consumer ranging over it should select on Closed alongside it to
+// know when to stop.
+func (mq *MultiQueue) Errors() <-chan error {
+	return mq.errors
+}
+
+// Closed returns a channel that's closed once Close has torn down every
+// bound queue, mirroring NFQueue.Closed.
+func (mq *MultiQueue) Closed() <-chan struct{} {
+	return mq.closed
+}
+
+// Close closes every bound queue.
+func (mq *MultiQueue) Close() {
+	for _, nfq := range mq.queues {
+		nfq.Close()
+	}
+	close(mq.closed)
+}
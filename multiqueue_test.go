@@ -0,0 +1,105 @@
+/*
+   Copyright 2014 Krishna Raman <kraman@gmail.com>
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package netfilter
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestNFQueue builds an NFQueue with just enough state for
+// forwardErrors, without opening a real driver.
+func newTestNFQueue() *NFQueue {
+	return &NFQueue{errors: make(chan error, 1), closed: make(chan struct{})}
+}
+
+func TestMultiQueueForwardErrors(t *testing.T) {
+	mq := &MultiQueue{errors: make(chan error), closed: make(chan struct{})}
+	nfq := newTestNFQueue()
+
+	done := make(chan struct{})
+	go func() {
+		mq.forwardErrors(nfq)
+		close(done)
+	}()
+
+	want := errors.New("boom")
+	nfq.reportError(want)
+
+	select {
+	case got := <-mq.Errors():
+		if got != want {
+			t.Errorf("forwarded error = %v, want %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for forwarded error")
+	}
+
+	close(nfq.closed)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("forwardErrors didn't return after nfq.Closed()")
+	}
+}
+
+// TestMultiQueueForwardErrorsExitsMidSend covers the case the NFQueue-level
+// fix (32822ee) missed one level up: a forwarder blocked trying to deliver
+// an error into mq.errors, with nothing reading MultiQueue.Errors(), must
+// still exit once mq.Close() runs instead of leaking forever.
+func TestMultiQueueForwardErrorsExitsMidSend(t *testing.T) {
+	mq := &MultiQueue{errors: make(chan error), closed: make(chan struct{})}
+	nfq := newTestNFQueue()
+
+	done := make(chan struct{})
+	go func() {
+		mq.forwardErrors(nfq)
+		close(done)
+	}()
+
+	nfq.reportError(errors.New("nobody is listening"))
+
+	// Give forwardErrors time to pick the error up off nfq.errors and
+	// block trying to send it into mq.errors, which nothing here reads.
+	time.Sleep(20 * time.Millisecond)
+
+	close(mq.closed)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("forwardErrors leaked instead of exiting on mq.Closed() mid-send")
+	}
+}
+
+func TestMultiQueueClosedClosesAfterClose(t *testing.T) {
+	mq := &MultiQueue{errors: make(chan error), closed: make(chan struct{})}
+
+	select {
+	case <-mq.Closed():
+		t.Fatal("Closed() channel closed before Close() was called")
+	default:
+	}
+
+	mq.Close()
+
+	select {
+	case <-mq.Closed():
+	default:
+		t.Fatal("Closed() channel not closed after Close()")
+	}
+}
@@ -19,87 +19,194 @@ Go bindings for libnetfilter_queue
 
 This library provides access to packets in the IPTables netfilter queue (NFQUEUE).
 The libnetfilter_queue library is part of the http://netfilter.org/projects/libnetfilter_queue/ project.
+
+By default this package is backed by the libnetfilter_queue cgo bindings. Building
+with the "netlink" tag switches to a pure-Go implementation that talks NFNETLINK_SUBSYS_QUEUE
+directly over an AF_NETLINK socket instead; see driver.go.
 */
 package netfilter
 
 //go:generate stringer -type=Verdict,Mark
 
-/*
-#cgo pkg-config: libnetfilter_queue
-#cgo CFLAGS: -Wall -Wno-unused-variable -I/usr/include -O2
-#cgo LDFLAGS: -L/usr/lib64/
-
-#include "netfilter.h"
-*/
-import "C"
-
 import (
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
 )
 
 //Verdict for a packet
-type Verdict C.uint
+type Verdict uint32
 
 //Mark for a packet
-type Mark C.uint
+type Mark uint32
 
 type NFPacket struct {
-	Packet []byte
-	qh     *C.struct_nfq_q_handle
-	id     C.uint32_t
+	Packet    []byte
+	Metadata  NFMetadata
+	Conntrack *NFConntrack
+	drv       driver
+	id        uint32
+	batcher   *verdictBatcher
+	poolBuf   *[]byte
+}
+
+// packetBufferPool backs NFQueueConfig.PooledBuffers: instead of a fresh
+// GoBytes-style allocation per packet, a driver copies the payload into a
+// buffer borrowed from here and hands it back via NFPacket.Release once the
+// caller is done with it. Sized for the 0xffff (NF_DEFAULT_PACKET_SIZE) max
+// packet range; NewNFQueueWithConfig rejects PooledBuffers combined with a
+// larger PacketSize or NFQueueFlagGSO, since either could hand back a
+// payload too big for these buffers.
+var packetBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, NF_DEFAULT_PACKET_SIZE)
+		return &buf
+	},
+}
+
+// Release returns Packet's underlying buffer to packetBufferPool, if it was
+// borrowed from one (see NFQueueConfig.PooledBuffers); it's a no-op
+// otherwise. Packet must not be read or written after calling Release.
+// SetVerdictBatched calls this automatically, since a batched verdict never
+// needs Packet again once queued; every other verdict method leaves this to
+// the caller.
+func (p *NFPacket) Release() {
+	if p.poolBuf == nil {
+		return
+	}
+	packetBufferPool.Put(p.poolBuf)
+	p.poolBuf = nil
+	p.Packet = nil
+}
+
+// NFMetadata holds the per-packet attributes the kernel reports alongside
+// the payload, so consumers can make routing/filtering decisions without
+// re-parsing the packet themselves.
+type NFMetadata struct {
+	// Mark is the packet's nfmark (nfq_get_nfmark).
+	Mark uint32
+
+	// HookNumber is the netfilter hook the packet was queued from (e.g.
+	// NF_INET_PRE_ROUTING), and ProtocolFamily is the layer-3 protocol
+	// reported for the hook (nfq_get_msg_packet_hdr).
+	HookNumber     uint8
+	ProtocolFamily uint16
+
+	// InIfIndex/OutIfIndex are the ifindex of the (possibly bridged)
+	// device the packet arrived on or is heading to; PhysIn/PhysOut are
+	// the physical ingress/egress device when the packet crossed a
+	// bridge (nfq_get_indev/outdev/physindev/physoutdev).
+	InIfIndex      uint32
+	OutIfIndex     uint32
+	PhysInIfIndex  uint32
+	PhysOutIfIndex uint32
+
+	// HwAddr is the source hardware (e.g. Ethernet) address, when the
+	// kernel was able to report one (nfq_get_packet_hw).
+	HwAddr []byte
+
+	// Timestamp is the kernel-reported arrival time of the packet
+	// (nfq_get_timestamp), zero if unavailable.
+	Timestamp time.Time
 }
 
 //Set the verdict for the packet
 func (p *NFPacket) SetVerdict(v Verdict) {
-	C.nfq_set_verdict(p.qh, p.id, C.uint(v), 0, nil)
+	p.flushBatch()
+	p.drv.Verdict(p.id, v, nil, nil)
 }
 
 //SetVerdictMark will set the packet mark.  Verdict will be NF_ACCEPT or NF_REPEAT.
 func (p *NFPacket) SetVerdictMark(m Mark) {
+	p.flushBatch()
 	verdict := NF_ACCEPT
 	if m == NF_MARK_REPEAT {
 		verdict = NF_REPEAT
 	}
-	C.nfq_set_verdict2(p.qh, p.id, C.uint(verdict), C.uint(m), 0, nil)
+	mark := uint32(m)
+	p.drv.Verdict(p.id, verdict, &mark, nil)
 }
 
 //SetRequeueVerdictMark will set the verdict and user defined mark for the packet (in the case of requeue)
 func (p *NFPacket) SetRequeueVerdictMark(newQueueId uint16, mark uint) {
+	p.flushBatch()
 	v := uint(NF_QUEUE)
 	q := (uint(newQueueId) << 16)
 	v = v | q
-	C.nfq_set_verdict2(p.qh, p.id, C.uint(v), C.uint(mark), 0, nil)
+	m := uint32(mark)
+	p.drv.Verdict(p.id, Verdict(v), &m, nil)
 }
 
 //Set the verdict for the packet (in the case of requeue)
 func (p *NFPacket) SetRequeueVerdict(newQueueId uint16) {
+	p.flushBatch()
 	v := uint(NF_QUEUE)
 	q := (uint(newQueueId) << 16)
 	v = v | q
-	C.nfq_set_verdict(p.qh, p.id, C.uint(v), 0, nil)
+	p.drv.Verdict(p.id, Verdict(v), nil, nil)
 }
 
 //Set the verdict for the packet AND provide new packet content for injection
 func (p *NFPacket) SetVerdictWithPacket(v Verdict, packet []byte) {
-	C.nfq_set_verdict(
-		p.qh,
-		p.id,
-		C.uint(v),
-		C.uint(len(packet)),
-		(*C.uchar)(unsafe.Pointer(&packet[0])),
-	)
+	p.flushBatch()
+	p.drv.Verdict(p.id, v, nil, packet)
+}
+
+// SetVerdictWithCtMark sets the packet's verdict and additionally asks the
+// kernel to set the connection's ctmark (masked by ctmask, so only the
+// covered bits are touched) via the NFQA_CT verdict extension. Requires
+// the owning queue to have been created with NFQueueFlagConntrack. This
+// lets a caller mark a connection once accepted so future packets on it
+// can be fast-pathed around further inspection, e.g. with an iptables/
+// nftables rule matching on the mark, the same way OpenGFW's
+// nfqueueConnMarkAccept short-circuits already-accepted flows.
+func (p *NFPacket) SetVerdictWithCtMark(v Verdict, ctmark, ctmask uint32) {
+	p.flushBatch()
+	p.drv.VerdictWithCtMark(p.id, v, ctmark, ctmask)
+}
+
+// SetVerdictBatched queues v for delivery via nfq_set_verdict_batch instead
+// of issuing an immediate nfq_set_verdict call, amortizing the cgo call
+// cost across many packets under high packet rates. If the owning queue
+// isn't in batch mode (see NFQueue.SetVerdictBatchMode), it behaves like
+// SetVerdict.
+func (p *NFPacket) SetVerdictBatched(v Verdict) {
+	if p.batcher == nil {
+		p.SetVerdict(v)
+	} else {
+		p.batcher.add(p.id, v)
+	}
+	p.Release()
+}
+
+// flushBatch flushes any pending batched verdict before this packet issues
+// a verdict of its own, so a batch never ends up covering a packet whose
+// verdict was actually set out-of-band (e.g. a payload rewrite or requeue).
+func (p *NFPacket) flushBatch() {
+	if p.batcher != nil {
+		p.batcher.flush()
+	}
 }
 
 type NFQueue struct {
-	h       *C.struct_nfq_handle
-	qh      *C.struct_nfq_q_handle
-	fd      C.int
+	drv     driver
 	packets chan NFPacket
-	idx     uint32
+	// batcher is set by SetVerdictBatchMode, read by the deliver closure
+	// from the driver's receive goroutine, and read by Close; all three
+	// can run concurrently, so it's an atomic.Pointer rather than a
+	// plain field.
+	batcher      atomic.Pointer[verdictBatcher]
+	errors       chan error
+	closeTimeout time.Duration
+	// closed is closed by Close() to let anything selecting on Errors()
+	// know no further errors are coming. errors itself is never closed:
+	// the driver's Close() can still report an error (e.g. the cgo
+	// driver's stuck-queue timer) concurrently with or after Close()
+	// returns, and closing a channel another goroutine may still be
+	// sending on would panic.
+	closed chan struct{}
 }
 
 const (
@@ -125,127 +232,255 @@ const (
 	NF_DEFAULT_PACKET_SIZE uint32 = 0xffff
 
 	ipv4version = 0x40
+
+	// defaultCloseTimeout is used when NFQueueConfig.CloseTimeout is zero.
+	defaultCloseTimeout = 5 * time.Second
 )
 
-var theTable = make(map[uint32]*chan NFPacket, 0)
-var theTabeLock sync.RWMutex
+// NFQueueFlag mirrors the NFQA_CFG_F_* flags the kernel accepts on an
+// NFQNL_MSG_CONFIG message, settable via NFQueueConfig.Flags.
+type NFQueueFlag uint32
+
+const (
+	// NFQueueFlagFailOpen makes the kernel accept packets instead of
+	// dropping them once the queue is full.
+	NFQueueFlagFailOpen NFQueueFlag = 1 << 0
+
+	// NFQueueFlagConntrack asks the kernel to attach the packet's
+	// conntrack entry as an NFQA_CT attribute.
+	NFQueueFlagConntrack NFQueueFlag = 1 << 1
+
+	// NFQueueFlagGSO asks the kernel to deliver GSO-sized packets
+	// instead of fragmenting them first, reducing per-packet overhead.
+	NFQueueFlagGSO NFQueueFlag = 1 << 2
+
+	// NFQueueFlagUIDGID asks the kernel to attach the originating
+	// socket's uid/gid, when known, as NFQA_UID/NFQA_GID attributes.
+	NFQueueFlagUIDGID NFQueueFlag = 1 << 3
+)
+
+// NFQueueConfig configures a queue beyond the queue number, giving access
+// to the NFQA_CFG_F_* flags. Pass it to NewNFQueueWithConfig; NewNFQueue is
+// a shorthand for the common case of no flags.
+type NFQueueConfig struct {
+	MaxPacketsInQueue uint32
+	PacketSize        uint32
+	Flags             NFQueueFlag
+
+	// CloseTimeout bounds how long Close waits for the driver to tear the
+	// queue down cleanly before forcing its file descriptor closed.
+	// Defaults to 5 seconds when zero.
+	CloseTimeout time.Duration
+
+	// PooledBuffers opts into delivering NFPacket.Packet from
+	// packetBufferPool instead of allocating fresh per packet, cutting GC
+	// pressure at high packet rates. Callers must call NFPacket.Release()
+	// once done with a packet (SetVerdictBatched does this automatically)
+	// before its buffer can be reused. Incompatible with a PacketSize
+	// above NF_DEFAULT_PACKET_SIZE or with NFQueueFlagGSO; NewNFQueueWithConfig
+	// rejects that combination.
+	PooledBuffers bool
+}
 
 // FailureVerdict is the default verdict in case of unexpected processing errors and is mutated by Fail-Open
 var FailureVerdict = NF_DROP
 
+// verdictBatcher accumulates packet ids sharing a verdict and flushes them
+// with a single VerdictBatch call instead of one Verdict call per packet.
+// VerdictBatch marks every not-yet-verdicted packet up to and including the
+// given id with a single verdict, so a batch can only span a run of
+// consecutive packets destined for the same verdict; flush() is called
+// whenever that run ends.
+type verdictBatcher struct {
+	mu       sync.Mutex
+	drv      driver
+	maxBatch int
+	maxDelay time.Duration
+	timer    *time.Timer
+
+	pending bool
+	verdict Verdict
+	lastID  uint32
+	count   int
+}
+
+func newVerdictBatcher(drv driver, maxBatch int, maxDelay time.Duration) *verdictBatcher {
+	return &verdictBatcher{drv: drv, maxBatch: maxBatch, maxDelay: maxDelay}
+}
+
+// add enqueues id under verdict v, flushing any batch already in progress
+// for a different verdict first.
+func (b *verdictBatcher) add(id uint32, v Verdict) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pending && b.verdict != v {
+		b.flushLocked()
+	}
+
+	b.verdict = v
+	b.lastID = id
+	b.pending = true
+	b.count++
+
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.maxDelay, b.flush)
+	}
+
+	if b.count >= b.maxBatch {
+		b.flushLocked()
+	}
+}
+
+func (b *verdictBatcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *verdictBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !b.pending {
+		return
+	}
+	b.drv.VerdictBatch(b.lastID, b.verdict)
+	b.pending = false
+	b.count = 0
+}
+
 //Create and bind to queue specified by queueId
 func NewNFQueue(queueId uint16, maxPacketsInQueue uint32, packetSize uint32) (*NFQueue, error) {
-	var nfq = NFQueue{}
-	var err error
-	var ret C.int
+	return NewNFQueueWithConfig(queueId, NFQueueConfig{
+		MaxPacketsInQueue: maxPacketsInQueue,
+		PacketSize:        packetSize,
+	})
+}
+
+// NewNFQueueWithConfig is like NewNFQueue, but additionally accepts
+// NFQueueConfig.Flags for kernel-side behavior (fail-open, GSO, conntrack
+// attachment, uid/gid attachment) that has no dedicated setter.
+func NewNFQueueWithConfig(queueId uint16, cfg NFQueueConfig) (*NFQueue, error) {
+	if cfg.PooledBuffers && cfg.PacketSize > NF_DEFAULT_PACKET_SIZE {
+		return nil, fmt.Errorf("PooledBuffers requires PacketSize <= %d, got %d", NF_DEFAULT_PACKET_SIZE, cfg.PacketSize)
+	}
+	if cfg.PooledBuffers && cfg.Flags&NFQueueFlagGSO != 0 {
+		return nil, fmt.Errorf("PooledBuffers is incompatible with NFQueueFlagGSO: GSO-sized packets can exceed the pool's %d-byte buffers", NF_DEFAULT_PACKET_SIZE)
+	}
 
-	if nfq.h, err = C.nfq_open(); err != nil {
+	nfq := &NFQueue{drv: newDriver(), errors: make(chan error, 16), closed: make(chan struct{})}
+
+	nfq.closeTimeout = cfg.CloseTimeout
+	if nfq.closeTimeout <= 0 {
+		nfq.closeTimeout = defaultCloseTimeout
+	}
+	nfq.drv.SetErrorHandler(nfq.reportError)
+	nfq.drv.SetPooledBuffers(cfg.PooledBuffers)
+
+	if err := nfq.drv.Open(); err != nil {
 		return nil, fmt.Errorf("Error opening NFQueue handle: %v\n", err)
 	}
 
-	if ret, err = C.nfq_unbind_pf(nfq.h, AF_INET); err != nil || ret < 0 {
+	if err := nfq.drv.Unbind(AF_INET); err != nil {
 		return nil, fmt.Errorf("Error unbinding existing NFQ handler from AF_INET protocol family: %v\n", err)
 	}
 
-	if ret, err = C.nfq_unbind_pf(nfq.h, AF_INET6); err != nil || ret < 0 {
+	if err := nfq.drv.Unbind(AF_INET6); err != nil {
 		return nil, fmt.Errorf("Error unbinding existing NFQ handler from AF_INET6 protocol family: %v\n", err)
 	}
 
-	if ret, err := C.nfq_bind_pf(nfq.h, AF_INET); err != nil || ret < 0 {
+	if err := nfq.drv.Bind(AF_INET); err != nil {
 		return nil, fmt.Errorf("Error binding to AF_INET protocol family: %v\n", err)
 	}
 
-	if ret, err := C.nfq_bind_pf(nfq.h, AF_INET6); err != nil || ret < 0 {
+	if err := nfq.drv.Bind(AF_INET6); err != nil {
 		return nil, fmt.Errorf("Error binding to AF_INET6 protocol family: %v\n", err)
 	}
 
 	nfq.packets = make(chan NFPacket)
-	nfq.idx = uint32(time.Now().UnixNano())
-	theTabeLock.Lock()
-	theTable[nfq.idx] = &nfq.packets
-	theTabeLock.Unlock()
-	if nfq.qh, err = C.CreateQueue(nfq.h, C.u_int16_t(queueId), C.u_int32_t(nfq.idx)); err != nil || nfq.qh == nil {
-		C.nfq_close(nfq.h)
+
+	deliver := func(p NFPacket) {
+		p.batcher = nfq.batcher.Load()
+		nfq.packets <- p
+	}
+	if err := nfq.drv.CreateQueue(queueId, deliver); err != nil {
 		return nil, fmt.Errorf("Error binding to queue: %v\n", err)
 	}
 
-	if ret, err = C.nfq_set_queue_maxlen(nfq.qh, C.u_int32_t(maxPacketsInQueue)); err != nil || ret < 0 {
-		C.nfq_destroy_queue(nfq.qh)
-		C.nfq_close(nfq.h)
+	if err := nfq.drv.SetMaxLen(cfg.MaxPacketsInQueue); err != nil {
+		nfq.drv.Close(nfq.closeTimeout)
 		return nil, fmt.Errorf("Unable to set max packets in queue: %v\n", err)
 	}
 
-	if C.nfq_set_mode(nfq.qh, C.u_int8_t(2), C.uint(packetSize)) < 0 {
-		C.nfq_destroy_queue(nfq.qh)
-		C.nfq_close(nfq.h)
+	if err := nfq.drv.SetMode(2, cfg.PacketSize); err != nil {
+		nfq.drv.Close(nfq.closeTimeout)
 		return nil, fmt.Errorf("Unable to set packets copy mode: %v\n", err)
 	}
 
-	if nfq.fd, err = C.nfq_fd(nfq.h); err != nil {
-		C.nfq_destroy_queue(nfq.qh)
-		C.nfq_close(nfq.h)
-		return nil, fmt.Errorf("Unable to get queue file-descriptor. %v\n", err)
+	if cfg.Flags != 0 {
+		if err := nfq.drv.SetFlags(cfg.Flags); err != nil {
+			nfq.drv.Close(nfq.closeTimeout)
+			return nil, fmt.Errorf("Unable to set queue flags: %v\n", err)
+		}
+		if cfg.Flags&NFQueueFlagFailOpen != 0 {
+			FailureVerdict = NF_ACCEPT
+		}
 	}
 
 	go nfq.run()
 
-	return &nfq, nil
+	return nfq, nil
 }
 
 // Unbind and close the queue
 // Close ensures that nfqueue resources are freed and closed.
-// C.stop_reading_packets() stops the reading packets loop, which causes
+// The driver's Close() stops the reading packets loop, which causes
 // go-subroutine run() to exit.
-// After exit, listening queue is destroyed and closed.
-// If for some reason any of the steps stucks while closing it, we'll exit by timeout.
-// reference:  https://bit.ly/35ybNRF
 func (nfq *NFQueue) Close() {
-	C.stop_reading_packets()
-	nfq.destroy()
+	if b := nfq.batcher.Load(); b != nil {
+		b.flush()
+	}
+	nfq.drv.Close(nfq.closeTimeout)
 	close(nfq.packets)
-	theTabeLock.Lock()
-	delete(theTable, nfq.idx)
-	theTabeLock.Unlock()
+	close(nfq.closed)
 }
 
-func (nfq *NFQueue) destroy() {
-	// we'll try to exit cleanly, but sometimes nfqueue gets stuck
-	time.AfterFunc(5*time.Second, func() {
-		fmt.Println("queue stuck, closing by timeout")
-		if nfq != nil {
-			C.close(nfq.fd)
-			nfq.closeNfq()
-		}
-		os.Exit(0)
-	})
-	C.nfq_unbind_pf(nfq.h, AF_INET)
-	C.nfq_unbind_pf(nfq.h, AF_INET6)
-	if nfq.qh != nil {
-		if ret := C.nfq_destroy_queue(nfq.qh); ret != 0 {
-			fmt.Printf("Queue.destroy() not destroyed: %d\n", ret)
-		}
-	}
+//Get the channel for packets
+func (nfq *NFQueue) GetPackets() <-chan NFPacket {
+	return nfq.packets
+}
 
-	nfq.closeNfq()
+// Errors returns a channel of asynchronous errors the driver can't return
+// directly to a caller: ENOBUFS-style receive failures, a callback fired
+// for an idx the driver no longer has registered, and forced closes on
+// CloseTimeout. A consumer that isn't reading this channel loses nothing
+// but the errors themselves; sends never block packet delivery. Errors is
+// never closed, so a consumer that needs to stop reading once the queue is
+// gone (e.g. a forwarding goroutine) should select on Closed alongside it.
+func (nfq *NFQueue) Errors() <-chan error {
+	return nfq.errors
 }
 
-func (nfq *NFQueue) closeNfq() {
-	if nfq.h != nil {
-		if ret := C.nfq_close(nfq.h); ret != 0 {
-			fmt.Printf("nfq_close() not closed: %d\n", ret)
-		}
-	}
+// Closed returns a channel that's closed once Close has torn the queue
+// down, so anything selecting on Errors() has a way to stop waiting.
+func (nfq *NFQueue) Closed() <-chan struct{} {
+	return nfq.closed
 }
 
-//Get the channel for packets
-func (nfq *NFQueue) GetPackets() <-chan NFPacket {
-	return nfq.packets
+// reportError delivers err to the Errors() channel without blocking,
+// dropping it if the channel's buffer is full.
+func (nfq *NFQueue) reportError(err error) {
+	select {
+	case nfq.errors <- err:
+	default:
+	}
 }
 
 //Set queue to "FAIL-OPEN"
 func (nfq *NFQueue) SetFailOpen() error {
-	ret, err := C.SetQueueFailOpen(nfq.qh)
-	if err != nil || ret < 0 {
+	if err := nfq.drv.SetFlags(NFQueueFlagFailOpen); err != nil {
 		return fmt.Errorf("Unable to set FAIL-OPEN on queue handle: %v\n", err)
 	}
 
@@ -254,36 +489,20 @@ func (nfq *NFQueue) SetFailOpen() error {
 	return nil
 }
 
-func (nfq *NFQueue) run() {
-	if errno := C.Run(nfq.h, nfq.fd); errno != 0 {
-		fmt.Fprintf(os.Stderr, "Terminating, unable to receive packet due to errno=%d\n", errno)
-	}
+// SetVerdictBatchMode switches the queue into batched-verdict mode: from
+// this point on, verdicts issued through NFPacket.SetVerdictBatched are
+// accumulated instead of applied immediately, and flushed together with a
+// single batched verdict call once maxBatch packets sharing the same
+// verdict have queued up or maxDelay has elapsed since the first of them,
+// whichever comes first. This amortizes the per-packet call cost, which
+// dominates at high packet rates.
+func (nfq *NFQueue) SetVerdictBatchMode(maxBatch int, maxDelay time.Duration) {
+	nfq.batcher.Store(newVerdictBatcher(nfq.drv, maxBatch, maxDelay))
 }
 
-//export go_callback
-func go_callback(packetId C.uint32_t, data *C.uchar, length C.int, idx uint32, qh *C.struct_nfq_q_handle) {
-	xdata := C.GoBytes(unsafe.Pointer(data), length)
-
-	p := NFPacket{
-		Packet: xdata,
-		qh:     qh,
-		id:     packetId,
-	}
-
-	theTabeLock.RLock()
-	cb, ok := theTable[idx]
-	theTabeLock.RUnlock()
-	if !ok {
-		disposition := "Dropping"
-		if FailureVerdict == NF_ACCEPT {
-			disposition = "[Fail-Open] Accepting"
-		}
-		fmt.Fprintf(os.Stderr, "%s, unexpectedly due to bad idx=%d\n", disposition, idx)
-		p.SetVerdict(FailureVerdict)
+func (nfq *NFQueue) run() {
+	if err := nfq.drv.Recv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Terminating, unable to receive packet: %v\n", err)
+		nfq.reportError(err)
 	}
-
-	// blocking write of packet to queue channel. We're doing a blocking write here to minimize the
-	// num of places where packets are dropped when we can't keep up with the processing. Blocking
-	// here means that packets will only be dropped by the kernel when the kernel queue is full.
-	*cb <- p
 }
@@ -0,0 +1,142 @@
+/*
+   Copyright 2014 Krishna Raman <kraman@gmail.com>
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package netfilter
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBatchDriver implements driver with every method a no-op except
+// VerdictBatch, which records its calls under a mutex so tests can inspect
+// them from outside verdictBatcher's own goroutines/timer callback.
+type fakeBatchDriver struct {
+	mu    sync.Mutex
+	calls []fakeBatchCall
+}
+
+type fakeBatchCall struct {
+	maxID   uint32
+	verdict Verdict
+}
+
+func (d *fakeBatchDriver) Open() error                                    { return nil }
+func (d *fakeBatchDriver) Bind(af int) error                              { return nil }
+func (d *fakeBatchDriver) Unbind(af int) error                            { return nil }
+func (d *fakeBatchDriver) CreateQueue(uint16, func(NFPacket)) error       { return nil }
+func (d *fakeBatchDriver) SetMode(uint8, uint32) error                    { return nil }
+func (d *fakeBatchDriver) SetMaxLen(uint32) error                         { return nil }
+func (d *fakeBatchDriver) SetFlags(NFQueueFlag) error                     { return nil }
+func (d *fakeBatchDriver) Recv() error                                    { return nil }
+func (d *fakeBatchDriver) Verdict(uint32, Verdict, *uint32, []byte) error { return nil }
+func (d *fakeBatchDriver) VerdictWithCtMark(uint32, Verdict, uint32, uint32) error {
+	return nil
+}
+func (d *fakeBatchDriver) SetErrorHandler(func(error)) {}
+func (d *fakeBatchDriver) SetPooledBuffers(bool)       {}
+func (d *fakeBatchDriver) Close(time.Duration) error   { return nil }
+
+func (d *fakeBatchDriver) VerdictBatch(maxID uint32, v Verdict) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, fakeBatchCall{maxID, v})
+	return nil
+}
+
+func (d *fakeBatchDriver) callCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.calls)
+}
+
+func (d *fakeBatchDriver) lastCall() fakeBatchCall {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls[len(d.calls)-1]
+}
+
+func TestVerdictBatcherSizeTrigger(t *testing.T) {
+	drv := &fakeBatchDriver{}
+	b := newVerdictBatcher(drv, 3, time.Hour)
+
+	b.add(1, NF_ACCEPT)
+	b.add(2, NF_ACCEPT)
+	if got := drv.callCount(); got != 0 {
+		t.Fatalf("calls after 2/3 adds = %d, want 0", got)
+	}
+
+	b.add(3, NF_ACCEPT)
+	if got := drv.callCount(); got != 1 {
+		t.Fatalf("calls after 3/3 adds = %d, want 1", got)
+	}
+	if call := drv.lastCall(); call.maxID != 3 || call.verdict != NF_ACCEPT {
+		t.Errorf("lastCall = %+v, want {3 NF_ACCEPT}", call)
+	}
+}
+
+func TestVerdictBatcherFlushOnVerdictMismatch(t *testing.T) {
+	drv := &fakeBatchDriver{}
+	b := newVerdictBatcher(drv, 10, time.Hour)
+
+	b.add(1, NF_ACCEPT)
+	b.add(2, NF_ACCEPT)
+	b.add(3, NF_DROP)
+
+	if got := drv.callCount(); got != 1 {
+		t.Fatalf("calls after a verdict change = %d, want 1", got)
+	}
+	if call := drv.lastCall(); call.maxID != 2 || call.verdict != NF_ACCEPT {
+		t.Errorf("batch flushed on mismatch = %+v, want {2 NF_ACCEPT}", call)
+	}
+
+	b.flush()
+	if got := drv.callCount(); got != 2 {
+		t.Fatalf("calls after explicit flush = %d, want 2", got)
+	}
+	if call := drv.lastCall(); call.maxID != 3 || call.verdict != NF_DROP {
+		t.Errorf("final flush = %+v, want {3 NF_DROP}", call)
+	}
+}
+
+func TestVerdictBatcherTimeTrigger(t *testing.T) {
+	drv := &fakeBatchDriver{}
+	b := newVerdictBatcher(drv, 100, 10*time.Millisecond)
+
+	b.add(1, NF_ACCEPT)
+	if got := drv.callCount(); got != 0 {
+		t.Fatalf("calls immediately after add = %d, want 0", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for drv.callCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := drv.callCount(); got != 1 {
+		t.Fatalf("calls after maxDelay elapsed = %d, want 1", got)
+	}
+}
+
+func TestVerdictBatcherFlushIsNoOpWhenEmpty(t *testing.T) {
+	drv := &fakeBatchDriver{}
+	b := newVerdictBatcher(drv, 10, time.Hour)
+
+	b.flush()
+	if got := drv.callCount(); got != 0 {
+		t.Fatalf("calls after flushing an empty batcher = %d, want 0", got)
+	}
+}